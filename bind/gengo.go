@@ -20,9 +20,15 @@ const (
 // File is generated by gopy gen. Do not edit.
 package main
 
-//#cgo pkg-config: python2 --cflags --libs
+//#cgo pkg-config: %[4]s --cflags --libs
 //#include <stdlib.h>
 //#include <string.h>
+//
+// /* cgopy_call_method dispatches ref's Python-bound method, looked up by
+//  * name, passing it the refnums in args; it is defined by the C shim, not
+//  * this file, which only needs the prototype to call it from the
+//  * GoPy_<Iface>_<Method> trampolines below. */
+// extern long long cgopy_call_method(void *ref, const char *method, long long *args, int nargs);
 import "C"
 
 import (
@@ -36,6 +42,12 @@ var _ = unsafe.Pointer(nil)
 
 // --- begin cgo helpers ---
 
+// CGoPy_GoString and CGoPy_CString move bytes across the boundary
+// unchanged: they do no UTF-8 encoding or decoding and behave the same for
+// every -python= target. Converting to and from PyUnicode_* (python3) or
+// PyString_* (python2) objects is left to the CPython side, which this
+// package does not generate.
+
 //export CGoPy_GoString
 func CGoPy_GoString(str *C.char) string { 
 	return C.GoString(str)
@@ -61,22 +73,33 @@ func CGoPy_ErrorString(err error) *C.char {
 // --- begin cref helpers ---
 
 type cobject struct {
-	ptr unsafe.Pointer
+	ptr interface{}
 	cnt int32
 }
 
-// refs stores Go objects that have been passed to another language.
+// refs stores Go objects that have been passed to another language, keyed
+// by whatever cgopy_incref was handed: a pointer for marshalIdent values
+// (so incref-ing the same *T twice lands on the same refnum), the address
+// genWrite took of the value it boxed for marshalValue ones (a fresh local
+// for each function result, so two calls returning an equal value mint
+// distinct refnums, but the same address, and so the same refnum, for a
+// package var or a struct field), or the argument value itself for the
+// GoPy_<Iface>_<Method> trampolines. Either way, no Go memory address is ever exposed across the cgo boundary itself —
+// C and Python only ever see the int32 refnum refs hands back.
 var refs struct {
 	sync.Mutex
 	next int32 // next reference number to use for Go object, always negative
-	refs map[unsafe.Pointer]int32
+	refs map[interface{}]int32
 	ptrs map[int32]cobject
 }
 
-//export cgopy_incref
-func cgopy_incref(ptr unsafe.Pointer) {
+// cgopy_incref registers v (a *T or other comparable Go value) in refs and
+// returns its refnum, bumping the count if it is already registered. It is
+// only ever called from generated Go code in this package, never directly
+// from C, since interface{} has no cgo-compatible representation.
+func cgopy_incref(v interface{}) int32 {
 	refs.Lock()
-	num, ok := refs.refs[ptr]
+	num, ok := refs.refs[v]
 	if ok {
 		s := refs.ptrs[num]
 		refs.ptrs[num] = cobject{s.ptr, s.cnt + 1}
@@ -86,23 +109,23 @@ func cgopy_incref(ptr unsafe.Pointer) {
 		if refs.next > 0 {
 			panic("refs.next underflow")
 		}
-		refs.refs[ptr] = num
-		refs.ptrs[num] = cobject{ptr, 1}
+		refs.refs[v] = num
+		refs.ptrs[num] = cobject{v, 1}
 	}
 	refs.Unlock()
+	return num
 }
 
 //export cgopy_decref
-func cgopy_decref(ptr unsafe.Pointer) {
+func cgopy_decref(num int32) {
 	refs.Lock()
-	num, ok := refs.refs[ptr]
+	s, ok := refs.ptrs[num]
 	if !ok {
 		panic("cgopy: decref untracked object")
 	}
-	s := refs.ptrs[num]
-	if s.cnt - 1 <= 0 {
+	if s.cnt-1 <= 0 {
 		delete(refs.ptrs, num)
-		delete(refs.refs, ptr)
+		delete(refs.refs, s.ptr)
 		refs.Unlock()
 		return
 	}
@@ -113,7 +136,7 @@ func cgopy_decref(ptr unsafe.Pointer) {
 func init() {
 	refs.Lock()
 	refs.next = -24 // Go objects get negative reference numbers. Arbitrary starting point.
-	refs.refs = make(map[unsafe.Pointer]int32)
+	refs.refs = make(map[interface{}]int32)
 	refs.ptrs = make(map[int32]cobject)
 	refs.Unlock()
 
@@ -132,25 +155,36 @@ type goGen struct {
 	fset *token.FileSet
 	pkg  *Package
 	err  ErrorList
+
+	// python is the target CPython major version (2 or 3), set from the
+	// gopy gen -python= flag. The zero value behaves as 2, so existing
+	// callers that don't set it keep generating python2 bindings.
+	python int
+}
+
+// pyPkgConfig returns the pkg-config module name for the target CPython
+// version, as consumed by goPreamble's #cgo pkg-config line.
+func (g *goGen) pyPkgConfig() string {
+	if g.python == 3 {
+		return "python3"
+	}
+	return "python2"
 }
 
 func (g *goGen) gen() error {
 
 	g.genPreamble()
 
-	for _, s := range g.pkg.structs {
-		g.genStruct(s)
+	for _, ifc := range g.pkg.ifaces {
+		g.genInterface(ifc)
 	}
 
-	// expose ctors at module level
-	// FIXME(sbinet): attach them to structs?
-	// -> problem is if one has 2 or more ctors with exactly the same signature.
 	for _, s := range g.pkg.structs {
-		for _, ctor := range s.ctors {
-			g.genFunc(ctor)
-		}
+		g.genStruct(s)
 	}
 
+	g.genCollections()
+
 	for _, f := range g.pkg.funcs {
 		g.genFunc(f)
 	}
@@ -174,6 +208,10 @@ func (g *goGen) gen() error {
 func (g *goGen) genFunc(f Func) {
 	sig := f.Signature()
 
+	if !g.checkResults(f.ID(), sig.Results()) {
+		return
+	}
+
 	params := "(" + g.tupleString(sig.Params()) + ")"
 	ret := g.tupleString(sig.Results())
 	if len(sig.Results()) > 1 {
@@ -204,6 +242,22 @@ func GoPy_%[1]s%[4]v%[5]v{
 func (g *goGen) genFuncBody(f Func) {
 	sig := f.Signature()
 	results := sig.Results()
+
+	args := sig.Params()
+	argNames := make([]string, len(args))
+	for i, arg := range args {
+		argNames[i] = arg.Name()
+		if arg.needWrap() {
+			dst := fmt.Sprintf("_gopy_arg_%03d", i)
+			goType := types.TypeString(
+				arg.GoType(),
+				func(*types.Package) string { return g.pkg.Name() },
+			)
+			g.genRead(dst, arg.Name(), goType, marshalValue)
+			argNames[i] = dst
+		}
+	}
+
 	for i := range results {
 		if i > 0 {
 			g.Printf(", ")
@@ -215,25 +269,11 @@ func (g *goGen) genFuncBody(f Func) {
 	}
 
 	g.Printf("%s.%s(", g.pkg.Name(), f.GoName())
-
-	args := sig.Params()
-	for i, arg := range args {
-		tail := ""
-		if i+1 < len(args) {
-			tail = ", "
-		}
-		head := arg.Name()
-		if arg.needWrap() {
-			head = fmt.Sprintf(
-				"*(*%s)(unsafe.Pointer(%s))",
-				types.TypeString(
-					arg.GoType(),
-					func(*types.Package) string { return g.pkg.Name() },
-				),
-				arg.Name(),
-			)
+	for i, name := range argNames {
+		if i > 0 {
+			g.Printf(", ")
 		}
-		g.Printf("%s%s", head, tail)
+		g.Printf("%s", name)
 	}
 	g.Printf(")\n")
 
@@ -241,38 +281,159 @@ func (g *goGen) genFuncBody(f Func) {
 		return
 	}
 
+	retNames := make([]string, len(results))
 	for i, res := range results {
-		if !res.needWrap() {
-			continue
+		retNames[i] = fmt.Sprintf("_gopy_%03d", i)
+		if res.needWrap() {
+			dst := fmt.Sprintf("_gopy_ret_%03d", i)
+			g.genWrite(dst, retNames[i], res.dtype.cgotype, marshalValue)
+			retNames[i] = dst
 		}
-		g.Printf("cgopy_incref(unsafe.Pointer(&_gopy_%03d))\n", i)
 	}
 
 	g.Printf("return ")
-	for i, res := range results {
+	for i, name := range retNames {
 		if i > 0 {
 			g.Printf(", ")
 		}
-		// if needWrap(res.GoType()) {
-		// 	g.Printf("")
-		// }
-		if res.needWrap() {
-			g.Printf("%s(unsafe.Pointer(&", res.dtype.cgotype)
+		g.Printf("%s", name)
+	}
+	g.Printf("\n")
+}
+
+// genInterface binds an exported named interface type by generating a
+// Go-side proxy that satisfies it and forwards every call back into
+// Python. GoPy_<Iface>_new takes the raw pointer to a Python object and
+// keeps it in the proxy's ref field; the proxy, not the Python object, is
+// what gets registered in refs. The CPython base class for Python
+// subclasses is not generated by this package.
+func (g *goGen) genInterface(ifc Interface) {
+	g.Printf("//export GoPy_%[1]s\n", ifc.ID())
+	g.Printf("// GoPy_%[1]s is a refnum into refs for a *gopy_%[1]s_proxy.\n", ifc.ID())
+	g.Printf("type GoPy_%[1]s int32\n\n", ifc.ID())
+
+	g.Printf(
+		"// gopy_%[1]s_proxy implements %[2]s.%[3]s by forwarding each\n"+
+			"// method call to the Python object that ref points to.\n",
+		ifc.ID(), g.pkg.Name(), ifc.GoName(),
+	)
+	g.Printf("type gopy_%[1]s_proxy struct {\n\tref unsafe.Pointer\n}\n\n", ifc.ID())
+
+	for _, m := range ifc.meths {
+		g.genInterfaceMethod(ifc, m)
+	}
+
+	g.Printf("//export GoPy_%[1]s_new\n", ifc.ID())
+	g.Printf("// GoPy_%[1]s_new wraps the Python object behind ref into a\n", ifc.ID())
+	g.Printf("// %[1]s.%[2]s satisfied by a %[3]s.\n", g.pkg.Name(), ifc.GoName(), "gopy_"+ifc.ID()+"_proxy")
+	g.Printf("func GoPy_%[1]s_new(ref unsafe.Pointer) GoPy_%[1]s {\n", ifc.ID())
+	g.Indent()
+	g.Printf("o := &gopy_%[1]s_proxy{ref: ref}\n", ifc.ID())
+	g.genWrite("num", "o", "GoPy_"+ifc.ID(), marshalIdent)
+	g.Printf("return num\n")
+	g.Outdent()
+	g.Printf("}\n\n")
+}
+
+func (g *goGen) genInterfaceMethod(ifc Interface, m Func) {
+	sig := m.Signature()
+	if !g.checkResults(ifc.ID()+"_"+m.GoName(), sig.Results()) {
+		return
+	}
+
+	params := "(" + g.tupleString(sig.Params()) + ")"
+	ret := g.tupleString(sig.Results())
+	if len(sig.Results()) > 1 {
+		ret = "(" + ret + ") "
+	} else {
+		ret += " "
+	}
+
+	// GoPy_<Iface>_<Method> is the trampoline a gopy_<Iface>_proxy calls
+	// into: it is //export'd like any other bound call, but instead of
+	// forwarding to a Go receiver it calls cgopy_call_method, which
+	// dispatches to the Python object's method of the same name. It takes
+	// the raw Python object pointer, not a refs refnum: ref identifies a
+	// PyObject* to the C shim, it is never a Go value shuttled through refs.
+	// Every argument is boxed through cgopy_incref first so cgopy_call_method
+	// only ever deals in refnums, never raw Go values or addresses.
+	trampolineParams := ""
+	if len(sig.Params()) > 0 {
+		trampolineParams = ", " + g.tupleString(sig.Params())
+	}
+	g.Printf("//export GoPy_%[1]s_%[2]s\n", ifc.ID(), m.GoName())
+	g.Printf("func GoPy_%[1]s_%[2]s(ref unsafe.Pointer%[3]v%[4]v{\n",
+		ifc.ID(), m.GoName(), trampolineParams, ret,
+	)
+	g.Indent()
+
+	cmethod := fmt.Sprintf("_gopy_method_%s_%s", ifc.ID(), m.GoName())
+	g.Printf("%s := C.CString(%q)\n", cmethod, m.GoName())
+	g.Printf("defer C.free(unsafe.Pointer(%s))\n", cmethod)
+
+	params := sig.Params()
+	g.Printf("_gopy_args := make([]C.longlong, %d)\n", len(params))
+	for i, p := range params {
+		g.Printf("_gopy_args[%d] = C.longlong(cgopy_incref(%s))\n", i, p.Name())
+	}
+	g.Printf("var _gopy_argp *C.longlong\n")
+	g.Printf("if len(_gopy_args) > 0 {\n")
+	g.Indent()
+	g.Printf("_gopy_argp = &_gopy_args[0]\n")
+	g.Outdent()
+	g.Printf("}\n")
+	g.Printf("_gopy_ret := C.cgopy_call_method(ref, %s, _gopy_argp, C.int(len(_gopy_args)))\n", cmethod)
+
+	results := sig.Results()
+	hasErr := len(results) > 0 && isErrorType(results[len(results)-1].GoType())
+	hasVal := (hasErr && len(results) == 2) || (!hasErr && len(results) == 1)
+	if hasVal {
+		goType := types.TypeString(results[0].GoType(), func(*types.Package) string { return g.pkg.Name() })
+		g.Printf("_gopy_val, _ := refs.ptrs[int32(_gopy_ret)].ptr.(%s)\n", goType)
+	}
+	if len(results) > 0 {
+		// A Python exception raised by the bound method isn't surfaced as
+		// a Go error yet: that needs the C shim to hand back a distinct
+		// sentinel refnum, which cgopy_call_method doesn't do.
+		g.Printf("return ")
+		if hasVal {
+			g.Printf("_gopy_val")
 		}
-		g.Printf("_gopy_%03d", i)
-		if res.needWrap() {
-			g.Printf("))")
+		if hasErr {
+			if hasVal {
+				g.Printf(", ")
+			}
+			g.Printf("nil")
 		}
+		g.Printf("\n")
 	}
-	g.Printf("\n")
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("func (p *gopy_%[1]s_proxy) %[2]s%[3]v%[4]v{\n",
+		ifc.ID(), m.GoName(), params, ret,
+	)
+	g.Indent()
+	if len(sig.Results()) > 0 {
+		g.Printf("return ")
+	}
+	g.Printf("GoPy_%[1]s_%[2]s(p.ref", ifc.ID(), m.GoName())
+	for _, arg := range sig.Params() {
+		g.Printf(", %s", arg.Name())
+	}
+	g.Printf(")\n")
+	g.Outdent()
+	g.Printf("}\n\n")
 }
 
 func (g *goGen) genStruct(s Struct) {
 	//fmt.Printf("obj: %#v\ntyp: %#v\n", obj, typ)
 	typ := s.Struct()
 	pkgname := s.Package().Name()
+	gotype := pkgname + "." + s.GoName()
 	g.Printf("//export GoPy_%[1]s\n", s.ID())
-	g.Printf("type GoPy_%[1]s unsafe.Pointer\n\n", s.ID())
+	g.Printf("// GoPy_%[1]s is a refnum into refs for a *%[2]s.\n", s.ID(), gotype)
+	g.Printf("type GoPy_%[1]s int32\n\n", s.ID())
 
 	for i := 0; i < typ.NumFields(); i++ {
 		f := typ.Field(i)
@@ -282,10 +443,20 @@ func (g *goGen) genStruct(s Struct) {
 
 		ft := f.Type()
 		ftname := g.qualifiedType(ft)
-		if needWrapType(ft) {
-			ftname = fmt.Sprintf("GoPy_%[1]s_field_%d", s.ID(), i+1)
-			g.Printf("//export %s\n", ftname)
-			g.Printf("type %s unsafe.Pointer\n\n", ftname)
+		switch ft.(type) {
+		case *types.Slice, *types.Map, *types.Array:
+			// ftname is already the canonical GoPy_slice_<elem>/
+			// GoPy_map_<key>_<elem>/GoPy_array_<n>_<elem> handle that
+			// genCollections emits (with its _len/_index/... helpers)
+			// for every slice, map, and array type this package
+			// mentions, field types included; reuse it here instead of
+			// minting a field-private handle with no helpers behind it.
+		default:
+			if needWrapType(ft) {
+				ftname = fmt.Sprintf("GoPy_%[1]s_field_%d", s.ID(), i+1)
+				g.Printf("//export %s\n", ftname)
+				g.Printf("type %s int32\n\n", ftname)
+			}
 		}
 
 		// -- getter --
@@ -296,14 +467,11 @@ func (g *goGen) genStruct(s Struct) {
 			ftname,
 		)
 		g.Indent()
-		g.Printf(
-			"ret := (*%[1]s)(unsafe.Pointer(self))\n",
-			pkgname+"."+s.GoName(),
-		)
+		g.genRead("ret", "self", gotype, marshalIdent)
 
 		if needWrapType(ft) {
-			g.Printf("cgopy_incref(unsafe.Pointer(&ret.%s))\n", f.Name())
-			g.Printf("return %s(unsafe.Pointer(&ret.%s))\n", ftname, f.Name())
+			g.genWrite("fld", "ret."+f.Name(), ftname, marshalValue)
+			g.Printf("return fld\n")
 		} else {
 			g.Printf("return ret.%s\n", f.Name())
 		}
@@ -316,23 +484,36 @@ func (g *goGen) genStruct(s Struct) {
 			s.ID(), i+1, ftname,
 		)
 		g.Indent()
+		g.genRead("ret", "self", gotype, marshalIdent)
 		fset := "v"
 		if needWrapType(ft) {
-			fset = fmt.Sprintf("*(*%s.%s)(unsafe.Pointer(v))",
-				f.Pkg().Name(),
-				types.TypeString(f.Type(), types.RelativeTo(f.Pkg())),
-			)
+			ftgo := f.Pkg().Name() + "." + types.TypeString(f.Type(), types.RelativeTo(f.Pkg()))
+			g.genRead("val", "v", ftgo, marshalValue)
+			fset = "val"
 		}
-		g.Printf(
-			"(*%[1]s)(unsafe.Pointer(self)).%[2]s = %[3]s\n",
-			pkgname+"."+s.GoName(),
-			f.Name(),
-			fset,
-		)
+		g.Printf("ret.%s = %s\n", f.Name(), fset)
 		g.Outdent()
 		g.Printf("}\n\n")
 	}
 
+	// Generate ctors and methods alongside the struct they belong to,
+	// rather than at module scope, so that s.ctors/s.meths is already
+	// grouped by type in the generated Go source for anyone reading it
+	// next to the struct's own GoPy_<id>/getter/setter stubs.
+	//
+	// FIXME(sbinet): this is still only a Go-side reordering. Binding Go
+	// methods as real Python methods needs a PyMethodDef <type>_methods[]
+	// table and a tp_init built from s.ctors/s.meths, emitted by the
+	// CPython generator; that generator doesn't exist anywhere in this
+	// tree, so nothing yet lets a Python caller write foo.Bar().Baz().
+	// This request stays open until that generator lands.
+	// -> when it does: if a struct has 2 or more ctors with exactly the
+	// same signature, only one can become tp_init; the rest need exposing
+	// as alternate factories.
+	for _, ctor := range s.ctors {
+		g.genFunc(ctor)
+	}
+
 	for _, m := range s.meths {
 		g.genMethod(s, m)
 	}
@@ -340,15 +521,20 @@ func (g *goGen) genStruct(s Struct) {
 	g.Printf("//export GoPy_%[1]s_new\n", s.ID())
 	g.Printf("func GoPy_%[1]s_new() GoPy_%[1]s {\n", s.ID())
 	g.Indent()
-	g.Printf("o := %[1]s.%[2]s{}\n", pkgname, s.GoName())
-	g.Printf("cgopy_incref(unsafe.Pointer(&o))\n")
-	g.Printf("return (GoPy_%[1]s)(unsafe.Pointer(&o))\n", s.ID())
+	g.Printf("o := &%[1]s.%[2]s{}\n", pkgname, s.GoName())
+	g.genWrite("num", "o", "GoPy_"+s.ID(), marshalIdent)
+	g.Printf("return num\n")
 	g.Outdent()
 	g.Printf("}\n\n")
 }
 
 func (g *goGen) genMethod(s Struct, m Func) {
 	sig := m.Signature()
+
+	if !g.checkResults(m.ID(), sig.Results()) {
+		return
+	}
+
 	params := "(self GoPy_" + s.ID()
 	if len(sig.Params()) > 0 {
 		params += ", " + g.tupleString(sig.Params())
@@ -377,6 +563,25 @@ func (g *goGen) genMethod(s Struct, m Func) {
 func (g *goGen) genMethodBody(s Struct, m Func) {
 	sig := m.Signature()
 	results := sig.Results()
+
+	gotype := g.pkg.Name() + "." + s.GoName()
+	g.genRead("self_", "self", gotype, marshalIdent)
+
+	args := sig.Params()
+	argNames := make([]string, len(args))
+	for i, arg := range args {
+		argNames[i] = arg.Name()
+		if arg.needWrap() {
+			dst := fmt.Sprintf("_gopy_arg_%03d", i)
+			goType := types.TypeString(
+				arg.GoType(),
+				func(*types.Package) string { return g.pkg.Name() },
+			)
+			g.genRead(dst, arg.Name(), goType, marshalValue)
+			argNames[i] = dst
+		}
+	}
+
 	for i := range results {
 		if i > 0 {
 			g.Printf(", ")
@@ -387,18 +592,12 @@ func (g *goGen) genMethodBody(s Struct, m Func) {
 		g.Printf(" := ")
 	}
 
-	g.Printf("(*%s.%s)(unsafe.Pointer(self)).%s(",
-		g.pkg.Name(), s.GoName(),
-		m.GoName(),
-	)
-
-	args := sig.Params()
-	for i, arg := range args {
-		tail := ""
-		if i+1 < len(args) {
-			tail = ", "
+	g.Printf("self_.%s(", m.GoName())
+	for i, name := range argNames {
+		if i > 0 {
+			g.Printf(", ")
 		}
-		g.Printf("%s%s", arg.Name(), tail)
+		g.Printf("%s", name)
 	}
 	g.Printf(")\n")
 
@@ -406,24 +605,101 @@ func (g *goGen) genMethodBody(s Struct, m Func) {
 		return
 	}
 
-	g.Printf("return ")
+	retNames := make([]string, len(results))
 	for i, res := range results {
-		if i > 0 {
-			g.Printf(", ")
-		}
-		// if needWrap(res.GoType()) {
-		// 	g.Printf("")
-		// }
+		retNames[i] = fmt.Sprintf("_gopy_%03d", i)
 		if res.needWrap() {
-			g.Printf("%s(unsafe.Pointer(&", res.dtype.cgotype)
+			dst := fmt.Sprintf("_gopy_ret_%03d", i)
+			g.genWrite(dst, retNames[i], res.dtype.cgotype, marshalValue)
+			retNames[i] = dst
 		}
-		g.Printf("_gopy_%03d", i)
-		if res.needWrap() {
-			g.Printf("))")
+	}
+
+	g.Printf("return ")
+	for i, name := range retNames {
+		if i > 0 {
+			g.Printf(", ")
 		}
+		g.Printf("%s", name)
 	}
 	g.Printf("\n")
+}
+
+// marshalMode selects the Go-level representation genRead/genWrite
+// exchange across the boundary: marshalValue reads/writes a copy of the
+// value, marshalIdent reads/writes a pointer to it, for receivers whose
+// fields must be observed or mutated in place (e.g. a bound struct's self).
+type marshalMode int
+
+const (
+	marshalValue marshalMode = iota
+	marshalIdent
+)
+
+// genWrite emits a statement assigning dst the wireType refnum obtained by
+// registering src in the refs table via cgopy_incref: with marshalValue,
+// src names a value and genWrite refs its address (so a value boxed at two
+// different call sites still gets two refnums today, even if they compare
+// equal); with marshalIdent, src already names a pointer, so the same *T
+// reliably lands on the same refnum. Either way this replaces the ad-hoc
+// cgopy_incref(unsafe.Pointer(&local)) calls this binder used to produce:
+// the int32 refnum is all that ever crosses the cgo boundary now, never a
+// raw unsafe.Pointer.
+func (g *goGen) genWrite(dst, src, wireType string, mode marshalMode) {
+	addr := src
+	if mode == marshalValue {
+		addr = "&" + src
+	}
+	g.Printf("%s := %s(cgopy_incref(%s))\n", dst, wireType, addr)
+}
 
+// genRead emits the statement(s) recovering, into dst, the Go value of
+// type goType that was registered in refs under the refnum src. With
+// marshalIdent, dst is the *goType pointer itself, suitable for mutating
+// the original; with marshalValue, dst is a copy dereferenced from it.
+// This replaces the ad-hoc *(*T)(unsafe.Pointer(...)) casts this binder
+// used to produce.
+func (g *goGen) genRead(dst, src, goType string, mode marshalMode) {
+	ptr := dst
+	if mode == marshalValue {
+		ptr = dst + "_ptr"
+	}
+	g.Printf("%s := refs.ptrs[int32(%s)].ptr.(*%s)\n", ptr, src, goType)
+	if mode == marshalValue {
+		g.Printf("%s := *%s\n", dst, ptr)
+	}
+}
+
+// checkResults enforces the gomobile-style result convention: a bound
+// function or method may return zero or one value, optionally followed
+// by a trailing error. This only gates which signatures genFunc/genMethod
+// accept and emit; turning that trailing error into a Python exception
+// (rather than an extra tuple member) is CGoPy_ErrorIsNil/CGoPy_ErrorString
+// in goPreamble's job to support, and the CPython wrapper generator's job
+// to actually call — that generator isn't part of this tree yet, so
+// nothing calls them. Shapes that don't fit this convention are rejected
+// with an ErrorList entry and are not emitted.
+func (g *goGen) checkResults(id string, results []*Var) bool {
+	switch n := len(results); {
+	case n <= 1:
+		return true
+	case n == 2 && isErrorType(results[1].GoType()):
+		return true
+	default:
+		g.err = append(g.err, fmt.Errorf(
+			"gopy: %s: functions and methods may only return zero or one value plus an optional trailing error",
+			id,
+		))
+		return false
+	}
+}
+
+// isErrorType reports whether typ is the built-in error interface, as
+// opposed to some other single-method interface that merely happens to be
+// named "error" in its own package (types.Identical compares the universe
+// error object's identity, not its name).
+func isErrorType(typ types.Type) bool {
+	return types.Identical(typ, types.Universe.Lookup("error").Type())
 }
 
 func (g *goGen) genConst(o Const) {
@@ -447,17 +723,11 @@ func (g *goGen) genVar(o Var) {
 	g.Printf("func GoPy_get_%[1]s() %[2]s {\n", o.id, ret)
 	g.Indent()
 	if o.needWrap() {
-		g.Printf("cgopy_incref(unsafe.Pointer(&%s.%s))\n", pkgname, o.Name())
-	}
-	g.Printf("return ")
-	if o.needWrap() {
-		g.Printf("%s(unsafe.Pointer(&", o.dtype.cgotype)
-	}
-	g.Printf("%s.%s", pkgname, o.Name())
-	if o.needWrap() {
-		g.Printf("))")
+		g.genWrite("num", fmt.Sprintf("%s.%s", pkgname, o.Name()), o.dtype.cgotype, marshalValue)
+		g.Printf("return num\n")
+	} else {
+		g.Printf("return %s.%s\n", pkgname, o.Name())
 	}
-	g.Printf("\n")
 	g.Outdent()
 	g.Printf("}\n\n")
 
@@ -467,11 +737,11 @@ func (g *goGen) genVar(o Var) {
 	vset := "v"
 	typ := o.GoType()
 	if needWrapType(typ) {
-		vset = fmt.Sprintf("*(*%s)(unsafe.Pointer(v))",
-			types.TypeString(typ, func(*types.Package) string {
-				return pkgname
-			}),
-		)
+		goType := types.TypeString(typ, func(*types.Package) string {
+			return pkgname
+		})
+		g.genRead("val", "v", goType, marshalValue)
+		vset = "val"
 	}
 	g.Printf(
 		"%[1]s.%[2]s = %[3]s\n",
@@ -481,9 +751,273 @@ func (g *goGen) genVar(o Var) {
 	g.Printf("}\n\n")
 }
 
+// genCollections emits an opaque handle and accessor helpers for every
+// slice, map, and array type that this package's bound funcs, ctors,
+// methods, interface methods, vars, and exported struct fields actually
+// mention, so that qualifiedType always has a concrete
+// GoPy_slice_<elem>/GoPy_map_<key>_<elem>/GoPy_array_<n>_<elem> type to
+// point readers and writers at. Element types are visited first, so a
+// [][]int emits GoPy_slice_int before GoPy_slice_slice_int; the handles of
+// named struct and interface element types come from genStruct and
+// genInterface instead.
+func (g *goGen) genCollections() {
+	seen := map[string]bool{}
+
+	visitSig := func(sig interface {
+		Params() []*Var
+		Results() []*Var
+	}) {
+		for _, p := range sig.Params() {
+			g.genCollectionFor(p.GoType(), seen)
+		}
+		for _, r := range sig.Results() {
+			g.genCollectionFor(r.GoType(), seen)
+		}
+	}
+
+	for _, f := range g.pkg.funcs {
+		visitSig(f.Signature())
+	}
+	for _, s := range g.pkg.structs {
+		for _, ctor := range s.ctors {
+			visitSig(ctor.Signature())
+		}
+		for _, m := range s.meths {
+			visitSig(m.Signature())
+		}
+	}
+	for _, ifc := range g.pkg.ifaces {
+		for _, m := range ifc.meths {
+			visitSig(m.Signature())
+		}
+	}
+	for _, v := range g.pkg.vars {
+		g.genCollectionFor(v.GoType(), seen)
+	}
+	for _, s := range g.pkg.structs {
+		typ := s.Struct()
+		for i := 0; i < typ.NumFields(); i++ {
+			f := typ.Field(i)
+			if !f.Exported() {
+				continue
+			}
+			g.genCollectionFor(f.Type(), seen)
+		}
+	}
+}
+
+// genCollectionFor emits the handle and helpers for typ if it is a slice,
+// map, or array and hasn't already been emitted, recursing into its
+// element (and, for maps, key) type first. A map also pulls in the
+// []key handle that its _keys helper returns.
+func (g *goGen) genCollectionFor(typ types.Type, seen map[string]bool) {
+	switch t := typ.(type) {
+	case *types.Slice:
+		g.genCollectionFor(t.Elem(), seen)
+		name := g.qualifiedType(t)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		g.genSlice(name, t.Elem())
+	case *types.Map:
+		g.genCollectionFor(t.Key(), seen)
+		g.genCollectionFor(t.Elem(), seen)
+		g.genCollectionFor(types.NewSlice(t.Key()), seen)
+		name := g.qualifiedType(t)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		g.genMap(name, t.Key(), t.Elem())
+	case *types.Array:
+		g.genCollectionFor(t.Elem(), seen)
+		name := g.qualifiedType(t)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		g.genArray(name, t.Elem(), t.Len())
+	}
+}
+
+func (g *goGen) goTypeString(typ types.Type) string {
+	return types.TypeString(typ, func(*types.Package) string { return g.pkg.Name() })
+}
+
+// genSlice binds a []elem type as the opaque refnum handle name, with
+// len/index/append helpers for a Python list/buffer wrapper to call; this
+// package emits only the Go side of that wrapper.
+func (g *goGen) genSlice(name string, elem types.Type) {
+	goElem := g.goTypeString(elem)
+	goSlice := "[]" + goElem
+	elemType := g.qualifiedType(elem)
+
+	g.Printf("//export %[1]s\n", name)
+	g.Printf("// %[1]s is a refnum into refs for a %[2]s.\n", name, goSlice)
+	g.Printf("type %[1]s int32\n\n", name)
+
+	g.Printf("//export %[1]s_len\n", name)
+	g.Printf("func %[1]s_len(h %[1]s) int {\n", name)
+	g.Indent()
+	g.genRead("s", "h", goSlice, marshalIdent)
+	g.Printf("return len(*s)\n")
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_index\n", name)
+	g.Printf("func %[1]s_index(h %[1]s, i int) %[2]s {\n", name, elemType)
+	g.Indent()
+	g.genRead("s", "h", goSlice, marshalIdent)
+	g.Printf("v := (*s)[i]\n")
+	if needWrapType(elem) {
+		g.genWrite("num", "v", elemType, marshalValue)
+		g.Printf("return num\n")
+	} else {
+		g.Printf("return v\n")
+	}
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_append\n", name)
+	g.Printf("func %[1]s_append(h %[1]s, v %[2]s) {\n", name, elemType)
+	g.Indent()
+	g.genRead("s", "h", goSlice, marshalIdent)
+	elt := "v"
+	if needWrapType(elem) {
+		g.genRead("elt", "v", goElem, marshalValue)
+		elt = "elt"
+	}
+	g.Printf("*s = append(*s, %s)\n", elt)
+	g.Outdent()
+	g.Printf("}\n\n")
+}
+
+// genMap binds a map[key]elem type as the opaque refnum handle name, with
+// len/get/set/del/keys helpers for a Python dict-like wrapper to call;
+// this package emits only the Go side of that wrapper (keys doubles as the
+// iteration primitive, returning a slice handle of the map's key type).
+func (g *goGen) genMap(name string, key, elem types.Type) {
+	goKey := g.goTypeString(key)
+	goElem := g.goTypeString(elem)
+	goMap := fmt.Sprintf("map[%s]%s", goKey, goElem)
+	keyType := g.qualifiedType(key)
+	elemType := g.qualifiedType(elem)
+	keysType := g.qualifiedType(types.NewSlice(key))
+
+	g.Printf("//export %[1]s\n", name)
+	g.Printf("// %[1]s is a refnum into refs for a %[2]s.\n", name, goMap)
+	g.Printf("type %[1]s int32\n\n", name)
+
+	g.Printf("//export %[1]s_len\n", name)
+	g.Printf("func %[1]s_len(h %[1]s) int {\n", name)
+	g.Indent()
+	g.genRead("m", "h", goMap, marshalIdent)
+	g.Printf("return len(*m)\n")
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_get\n", name)
+	g.Printf("func %[1]s_get(h %[1]s, k %[2]s) %[3]s {\n", name, keyType, elemType)
+	g.Indent()
+	g.genRead("m", "h", goMap, marshalIdent)
+	k := "k"
+	if needWrapType(key) {
+		g.genRead("kk", "k", goKey, marshalValue)
+		k = "kk"
+	}
+	g.Printf("v := (*m)[%s]\n", k)
+	if needWrapType(elem) {
+		g.genWrite("num", "v", elemType, marshalValue)
+		g.Printf("return num\n")
+	} else {
+		g.Printf("return v\n")
+	}
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_set\n", name)
+	g.Printf("func %[1]s_set(h %[1]s, k %[2]s, v %[3]s) {\n", name, keyType, elemType)
+	g.Indent()
+	g.genRead("m", "h", goMap, marshalIdent)
+	k = "k"
+	if needWrapType(key) {
+		g.genRead("kk", "k", goKey, marshalValue)
+		k = "kk"
+	}
+	v := "v"
+	if needWrapType(elem) {
+		g.genRead("vv", "v", goElem, marshalValue)
+		v = "vv"
+	}
+	g.Printf("(*m)[%s] = %s\n", k, v)
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_del\n", name)
+	g.Printf("func %[1]s_del(h %[1]s, k %[2]s) {\n", name, keyType)
+	g.Indent()
+	g.genRead("m", "h", goMap, marshalIdent)
+	k = "k"
+	if needWrapType(key) {
+		g.genRead("kk", "k", goKey, marshalValue)
+		k = "kk"
+	}
+	g.Printf("delete(*m, %s)\n", k)
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_keys\n", name)
+	g.Printf("// %[1]s_keys returns a %[2]s snapshot of the map's keys, for\n", name, keysType)
+	g.Printf("// iteration on the Python side.\n")
+	g.Printf("func %[1]s_keys(h %[1]s) %[2]s {\n", name, keysType)
+	g.Indent()
+	g.genRead("m", "h", goMap, marshalIdent)
+	g.Printf("ks := make([]%s, 0, len(*m))\n", goKey)
+	g.Printf("for k := range *m {\n\tks = append(ks, k)\n}\n")
+	g.genWrite("num", "ks", keysType, marshalValue)
+	g.Printf("return num\n")
+	g.Outdent()
+	g.Printf("}\n\n")
+}
+
+// genArray binds a fixed-length [n]elem type as the opaque refnum handle
+// name, with len/index helpers for a Python fixed-length sequence wrapper
+// to call; this package emits only the Go side of that wrapper.
+func (g *goGen) genArray(name string, elem types.Type, n int64) {
+	goElem := g.goTypeString(elem)
+	goArray := fmt.Sprintf("[%d]%s", n, goElem)
+	elemType := g.qualifiedType(elem)
+
+	g.Printf("//export %[1]s\n", name)
+	g.Printf("// %[1]s is a refnum into refs for a %[2]s.\n", name, goArray)
+	g.Printf("type %[1]s int32\n\n", name)
+
+	g.Printf("//export %[1]s_len\n", name)
+	g.Printf("func %[1]s_len(h %[1]s) int {\n", name)
+	g.Indent()
+	g.Printf("return %d\n", n)
+	g.Outdent()
+	g.Printf("}\n\n")
+
+	g.Printf("//export %[1]s_index\n", name)
+	g.Printf("func %[1]s_index(h %[1]s, i int) %[2]s {\n", name, elemType)
+	g.Indent()
+	g.genRead("a", "h", goArray, marshalIdent)
+	g.Printf("v := a[i]\n")
+	if needWrapType(elem) {
+		g.genWrite("num", "v", elemType, marshalValue)
+		g.Printf("return num\n")
+	} else {
+		g.Printf("return v\n")
+	}
+	g.Outdent()
+	g.Printf("}\n\n")
+}
+
 func (g *goGen) genPreamble() {
 	n := g.pkg.pkg.Name()
-	g.Printf(goPreamble, n, g.pkg.pkg.Path(), filepath.Base(n))
+	g.Printf(goPreamble, n, g.pkg.pkg.Path(), filepath.Base(n), g.pyPkgConfig())
 }
 
 func (g *goGen) tupleString(tuple []*Var) string {
@@ -515,11 +1049,30 @@ func (g *goGen) qualifiedType(typ types.Type) string {
 			if obj.Name() == "error" {
 				return "error"
 			}
-			return "GoPy_" + obj.Name()
+			// bound interfaces are backed by a gopy_<id>_proxy (see
+			// genInterface) and shuttled across the boundary the same
+			// way structs are: as an opaque GoPy_<pkg>_<Name> handle.
+			return "GoPy_" + obj.Pkg().Name() + "_" + obj.Name()
 		default:
 			return "GoPy_ooops_" + obj.Name()
 		}
+	case *types.Slice:
+		return "GoPy_slice_" + elemHandleName(g.qualifiedType(typ.Elem()))
+	case *types.Map:
+		return "GoPy_map_" +
+			elemHandleName(g.qualifiedType(typ.Key())) + "_" +
+			elemHandleName(g.qualifiedType(typ.Elem()))
+	case *types.Array:
+		return fmt.Sprintf("GoPy_array_%d_%s", typ.Len(), elemHandleName(g.qualifiedType(typ.Elem())))
 	}
 
+	g.err = append(g.err, fmt.Errorf("gopy: unsupported type %s", typ))
 	return fmt.Sprintf("%#T", typ)
 }
+
+// elemHandleName strips the GoPy_ prefix off a qualifiedType result so it
+// can be embedded in a composite handle name (GoPy_slice_<elem>,
+// GoPy_map_<key>_<elem>) without stuttering.
+func elemHandleName(qtype string) string {
+	return strings.TrimPrefix(qtype, "GoPy_")
+}
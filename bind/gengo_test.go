@@ -0,0 +1,93 @@
+// Copyright 2015 The go-python Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bind
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/types"
+)
+
+// TestCtorFixmeNotHidden guards against genStruct's ctor/method loop being
+// relabeled as done again: binding Go methods as real Python methods still
+// needs a PyMethodDef table and tp_init that nothing in this tree emits,
+// and that gap must stay visible in the source, not be papered over.
+func TestCtorFixmeNotHidden(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "gengo.go", nil, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse gengo.go: %v", err)
+	}
+	for _, cg := range f.Comments {
+		if strings.Contains(cg.Text(), "FIXME(sbinet): this is still only a Go-side reordering") {
+			return
+		}
+	}
+	t.Error("genStruct must keep the FIXME(sbinet) marker noting PyMethodDef/tp_init emission is unimplemented")
+}
+
+func TestPyPkgConfig(t *testing.T) {
+	for _, tc := range []struct {
+		python int
+		want   string
+	}{
+		{0, "python2"},
+		{2, "python2"},
+		{3, "python3"},
+	} {
+		g := &goGen{python: tc.python}
+		if got := g.pyPkgConfig(); got != tc.want {
+			t.Errorf("pyPkgConfig() with python=%d = %q, want %q", tc.python, got, tc.want)
+		}
+	}
+}
+
+func TestIsErrorType(t *testing.T) {
+	errType := types.Universe.Lookup("error").Type()
+	if !isErrorType(errType) {
+		t.Error("isErrorType(error) = false, want true")
+	}
+	if isErrorType(types.Typ[types.Int]) {
+		t.Error("isErrorType(int) = true, want false")
+	}
+
+	// A package-local interface that merely happens to be named "error"
+	// (here with a single Oops method) must not be mistaken for the
+	// builtin: it has its own return value that a caller needs, not a
+	// suppressed error.
+	pkg := types.NewPackage("example.com/shadow", "shadow")
+	sig := types.NewSignature(nil, nil, nil, false)
+	method := types.NewFunc(0, pkg, "Oops", sig)
+	iface := types.NewInterface([]*types.Func{method}, nil).Complete()
+	obj := types.NewTypeName(0, pkg, "error", nil)
+	shadowed := types.NewNamed(obj, iface, nil)
+	if isErrorType(shadowed) {
+		t.Error("isErrorType(shadowed local error interface) = true, want false")
+	}
+}
+
+// TestPreambleDeclaresCallMethod guards against the generated interface
+// trampolines calling a C.cgopy_call_method that the preamble never
+// declared an extern prototype for.
+func TestPreambleDeclaresCallMethod(t *testing.T) {
+	if !strings.Contains(goPreamble, "extern long long cgopy_call_method(") {
+		t.Error("goPreamble must declare an extern prototype for cgopy_call_method")
+	}
+}
+
+func TestElemHandleName(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"GoPy_slice_int", "slice_int"},
+		{"GoPy_pkg_MyStruct", "pkg_MyStruct"},
+		{"int", "int"},
+	} {
+		if got := elemHandleName(tc.in); got != tc.want {
+			t.Errorf("elemHandleName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}